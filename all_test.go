@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -65,3 +66,52 @@ func TestServer(t *testing.T) {
 	}
 	resp.Body.Close()
 }
+
+func TestDialerProxyJump(t *testing.T) {
+	// Both servers must bind an explicit loopback address rather than
+	// the wildcard ":0": the second hop asks the bastion to
+	// direct-tcpip dial the inside server's listener address, and a
+	// wildcard address (e.g. "[::]:port") is not a valid dial target.
+	bastion, err := NewSimpleServer("ssh://u:p@127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bastion.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer bastion.Close()
+
+	inside, err := NewSimpleServer("ssh://u:p@127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inside.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer inside.Close()
+
+	ur, err := url.Parse(inside.ProxyURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := ur.Query()
+	q.Add("jump", bastion.ProxyURL())
+	ur.RawQuery = q.Encode()
+
+	dial, err := NewDialer(ur.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dial.Close()
+
+	cli := testServer.Client()
+	cli.Transport = &http.Transport{
+		DialContext: dial.DialContext,
+	}
+
+	resp, err := cli.Get(testServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
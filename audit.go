@@ -0,0 +1,66 @@
+package sshproxy
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditEventType identifies the kind of session event an AuditLogger records.
+type AuditEventType string
+
+// AuditAuthAttempt is logged for every password/public-key/certificate
+// authentication attempt, successful or not. It is currently the only
+// event SimpleServer emits: channel opens/closes, port-forward requests
+// and command execs are handled entirely inside the external
+// github.com/wzshiming/sshd channel-type packages (session,
+// tcpforward, ...), which self-register globally by channel/request
+// type name and expose no per-connection hook a Server could wrap to
+// observe them.
+const AuditAuthAttempt AuditEventType = "auth_attempt"
+
+// AuditEvent is a single entry in the audit trail.
+type AuditEvent struct {
+	Type       AuditEventType `json:"type"`
+	Time       time.Time      `json:"time"`
+	User       string         `json:"user"`
+	RemoteAddr string         `json:"remote_addr,omitempty"`
+	Allowed    bool           `json:"allowed"`
+	Reason     string         `json:"reason,omitempty"`
+}
+
+// AuditLogger records audit events for a Server. Implementations must be
+// safe for concurrent use, since events are logged from per-connection
+// goroutines.
+type AuditLogger interface {
+	LogAudit(event AuditEvent)
+}
+
+// NoopAuditLogger discards every event. It is the default AuditLogger for
+// a SimpleServer that hasn't been given one explicitly.
+type NoopAuditLogger struct{}
+
+// LogAudit implements AuditLogger.
+func (NoopAuditLogger) LogAudit(AuditEvent) {}
+
+// JSONLinesAuditLogger writes each AuditEvent as one line of JSON to w.
+// It is safe for concurrent use.
+type JSONLinesAuditLogger struct {
+	mut sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONLinesAuditLogger returns an AuditLogger that appends each event
+// to w as a line of JSON.
+func NewJSONLinesAuditLogger(w io.Writer) *JSONLinesAuditLogger {
+	return &JSONLinesAuditLogger{enc: json.NewEncoder(w)}
+}
+
+// LogAudit implements AuditLogger. Encoding errors are discarded, the same
+// as a logger writing past a closed destination would be.
+func (l *JSONLinesAuditLogger) LogAudit(event AuditEvent) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	_ = l.enc.Encode(event)
+}
@@ -1,7 +1,10 @@
 package sshproxy
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
@@ -11,23 +14,31 @@ import (
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // NewDialer returns a new Dialer that dials through the provided
 // proxy server's network and address.
+//
+// addr may describe a chain of SSH hops, either as comma-separated URLs
+// ("ssh://u1:p1@bastion:22,ssh://u2:p2@inside:22") or as one or more
+// repeated jump= query params on the final URL
+// ("ssh://u2:p2@inside:22?jump=ssh://u1:p1@bastion:22"). Each hop is
+// dialed in turn through the previous one, mirroring OpenSSH's ProxyJump.
 func NewDialer(addr string) (*Dialer, error) {
-	config, err := parseClientConfig(addr)
+	chain, err := parseClientConfigChain(addr)
 	if err != nil {
 		return nil, err
 	}
-	return NewDialerWithConfig(config.host, config.clientConfig)
+	hops := make([]dialerHop, len(chain))
+	for i, c := range chain {
+		hops[i] = dialerHop{host: c.host, config: c.clientConfig}
+	}
+	return &Dialer{hops: hops}, nil
 }
 
 func NewDialerWithConfig(host string, config *ssh.ClientConfig) (*Dialer, error) {
-	return &Dialer{
-		host:   host,
-		config: config,
-	}, nil
+	return &Dialer{hops: []dialerHop{{host: host, config: config}}}, nil
 }
 
 type clientConfig struct {
@@ -35,6 +46,33 @@ type clientConfig struct {
 	clientConfig *ssh.ClientConfig
 }
 
+// parseClientConfigChain parses addr into the clientConfig for each hop
+// of a ProxyJump-style chain, in dial order.
+func parseClientConfigChain(addr string) ([]*clientConfig, error) {
+	addrs := []string{addr}
+	if strings.Contains(addr, ",") {
+		addrs = strings.Split(addr, ",")
+	} else {
+		ur, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		if jumps := ur.Query()["jump"]; len(jumps) != 0 {
+			addrs = append(append([]string{}, jumps...), addr)
+		}
+	}
+
+	chain := make([]*clientConfig, 0, len(addrs))
+	for _, a := range addrs {
+		cfg, err := parseClientConfig(a)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cfg)
+	}
+	return chain, nil
+}
+
 func parseClientConfig(addr string) (*clientConfig, error) {
 	ur, err := url.Parse(addr)
 	if err != nil {
@@ -50,23 +88,46 @@ func parseClientConfig(addr string) (*clientConfig, error) {
 	}
 
 	config := &ssh.ClientConfig{
-		User:            user,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User: user,
 	}
 
 	if isPwd {
 		config.Auth = append(config.Auth, ssh.Password(pwd))
 	}
 
+	callback, err := hostKeyCallback(ur)
+	if err != nil {
+		return nil, err
+	}
+	config.HostKeyCallback = callback
+
 	identityDatas, err := getQuery(ur.Query()["identity_data"], ur.Query()["identity_file"])
 	if err != nil {
 		return nil, err
 	}
-	for _, data := range identityDatas {
+	certificateDatas, err := getQuery(ur.Query()["certificate_data"], ur.Query()["certificate_file"])
+	if err != nil {
+		return nil, err
+	}
+	for i, data := range identityDatas {
 		signer, err := ssh.ParsePrivateKey(data)
 		if err != nil {
 			return nil, err
 		}
+		if i < len(certificateDatas) {
+			pub, _, _, _, err := ssh.ParseAuthorizedKey(certificateDatas[i])
+			if err != nil {
+				return nil, err
+			}
+			cert, ok := pub.(*ssh.Certificate)
+			if !ok {
+				return nil, fmt.Errorf("certificate_file: not an ssh certificate")
+			}
+			signer, err = ssh.NewCertSigner(cert, signer)
+			if err != nil {
+				return nil, err
+			}
+		}
 		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
 	}
 
@@ -93,27 +154,91 @@ func parseClientConfig(addr string) (*clientConfig, error) {
 	}, nil
 }
 
+// hostKeyCallback builds the ssh.HostKeyCallback used to verify the proxy
+// server's host key, from the known_hosts_file=/known_hosts_data= and
+// host_key_fingerprint= query params. It only falls back to
+// ssh.InsecureIgnoreHostKey when insecure=1 is set explicitly, and errors
+// out otherwise so a missing configuration fails loudly instead of
+// silently skipping verification.
+func hostKeyCallback(ur *url.URL) (ssh.HostKeyCallback, error) {
+	knownHostsDatas, err := getQuery(ur.Query()["known_hosts_data"], ur.Query()["known_hosts_file"])
+	if err != nil {
+		return nil, err
+	}
+	if len(knownHostsDatas) != 0 {
+		f, err := ioutil.TempFile("", "sshproxy-known-hosts-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.Write(bytes.Join(knownHostsDatas, []byte{'\n'}))
+		if err1 := f.Close(); err == nil {
+			err = err1
+		}
+		if err != nil {
+			return nil, err
+		}
+		return knownhosts.New(f.Name())
+	}
+
+	if fingerprint := ur.Query().Get("host_key_fingerprint"); fingerprint != "" {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			got := ssh.FingerprintSHA256(key)
+			if !strings.EqualFold(got, fingerprint) {
+				return fmt.Errorf("host key fingerprint mismatch: got %q, want %q", got, fingerprint)
+			}
+			return nil
+		}, nil
+	}
+
+	if insecure, _ := strconv.ParseBool(ur.Query().Get("insecure")); insecure {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	return nil, fmt.Errorf("no host key verification configured: set known_hosts_file, known_hosts_data, host_key_fingerprint, or insecure=1")
+}
+
+// dialerHop is one leg of a (possibly ProxyJump-chained) dial: the
+// ssh.ClientConfig used to authenticate to host once the transport
+// connection to it is open.
+type dialerHop struct {
+	host   string
+	config *ssh.ClientConfig
+}
+
 type Dialer struct {
 	localAddr net.Addr
 	// ProxyDial specifies the optional dial function for
-	// establishing the transport connection.
+	// establishing the transport connection to the first hop.
 	ProxyDial func(context.Context, string, string) (net.Conn, error)
 
-	host   string
-	config *ssh.ClientConfig
+	hops []dialerHop
 
-	mut    sync.RWMutex
-	sshCli *ssh.Client
+	mut     sync.RWMutex
+	clients []*ssh.Client
+	shell   remoteShell
 }
 
 func (d *Dialer) Close() error {
 	d.mut.Lock()
 	defer d.mut.Unlock()
-	if d.sshCli == nil {
+	if len(d.clients) == 0 {
 		return nil
 	}
-	err := d.sshCli.Close()
-	d.sshCli = nil
+	err := closeClients(d.clients)
+	d.clients = nil
+	return err
+}
+
+// closeClients closes a hop chain in reverse order, so later hops (which
+// depend on earlier ones for their transport) are torn down first.
+func closeClients(clients []*ssh.Client) error {
+	var err error
+	for i := len(clients) - 1; i >= 0; i-- {
+		if cerr := clients[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
 	return err
 }
 
@@ -128,43 +253,191 @@ func (d *Dialer) proxyDial(ctx context.Context, network, address string) (net.Co
 
 func (d *Dialer) SSHClient(ctx context.Context) (*ssh.Client, error) {
 	d.mut.RLock()
-	sshCli := d.sshCli
+	clients := d.clients
+	d.mut.RUnlock()
+
+	if len(clients) == len(d.hops) {
+		return clients[len(clients)-1], nil
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if len(d.clients) == len(d.hops) {
+		return d.clients[len(d.clients)-1], nil
+	}
+
+	clients = make([]*ssh.Client, 0, len(d.hops))
+	for i, hop := range d.hops {
+		var conn net.Conn
+		var err error
+		if i == 0 {
+			conn, err = d.proxyDial(ctx, "tcp", hop.host)
+		} else {
+			conn, err = clients[i-1].DialContext(ctx, "tcp", hop.host)
+		}
+		if err != nil {
+			closeClients(clients)
+			return nil, err
+		}
+
+		con, chans, reqs, err := ssh.NewClientConn(conn, hop.host, hop.config)
+		if err != nil {
+			conn.Close()
+			closeClients(clients)
+			return nil, err
+		}
+		clients = append(clients, ssh.NewClient(con, chans, reqs))
+	}
+
+	d.clients = clients
+	return clients[len(clients)-1], nil
+}
+
+// remoteShell identifies the quoting convention CommandDialContext must
+// use to build a command line the remote side will parse correctly.
+type remoteShell int
+
+const (
+	shellUnknown remoteShell = iota
+	shellPOSIX
+	shellCmd
+	shellPowerShell
+)
+
+// detectShell runs cheap probe commands over the SSH connection to tell
+// which of the three quoting conventions CommandDialContext must use for
+// the remote default shell, and caches the result on d so later calls
+// don't re-probe.
+//
+// "echo %OS%" tells POSIX shells (no such expansion; the literal text is
+// echoed back) apart from either Windows shell (cmd.exe expands %OS% to
+// "Windows_NT" whether it's parsing the command line itself or running as
+// a child process spawned by PowerShell to honor it). A second, purely
+// PowerShell probe then distinguishes the two: cmd.exe has no "$..."
+// variable syntax and echoes it back literally, while PowerShell expands
+// $PSVersionTable.PSVersion.Major to a plain integer.
+func (d *Dialer) detectShell(ctx context.Context) (remoteShell, error) {
+	d.mut.RLock()
+	shell := d.shell
 	d.mut.RUnlock()
+	if shell != shellUnknown {
+		return shell, nil
+	}
 
-	if sshCli != nil {
-		return sshCli, nil
+	// SSHClient takes d.mut itself, so it must be called before d.mut is
+	// locked here.
+	cli, err := d.SSHClient(ctx)
+	if err != nil {
+		return shellUnknown, err
 	}
 
 	d.mut.Lock()
 	defer d.mut.Unlock()
-	if d.sshCli != nil {
-		return d.sshCli, nil
+	if d.shell != shellUnknown {
+		return d.shell, nil
 	}
 
-	conn, err := d.proxyDial(ctx, "tcp", d.host)
+	shell, err = probeShell(cli)
 	if err != nil {
-		return nil, err
+		return shellUnknown, err
 	}
+	d.shell = shell
+	return shell, nil
+}
 
-	con, chans, reqs, err := ssh.NewClientConn(conn, d.host, d.config)
+func probeShell(cli *ssh.Client) (remoteShell, error) {
+	sess, err := cli.NewSession()
 	if err != nil {
-		return nil, err
+		return shellUnknown, err
 	}
+	defer sess.Close()
 
-	d.sshCli = ssh.NewClient(con, chans, reqs)
-	return d.sshCli, nil
+	out, err := sess.Output("echo %OS%")
+	if err != nil {
+		return shellUnknown, err
+	}
+	if !strings.Contains(string(out), "Windows_NT") {
+		return shellPOSIX, nil
+	}
+
+	sess, err = cli.NewSession()
+	if err != nil {
+		return shellUnknown, err
+	}
+	defer sess.Close()
+
+	// Errors here (e.g. cmd.exe rejecting the "$..." syntax outright) mean
+	// this isn't PowerShell; fall through to shellCmd below.
+	out, _ = sess.Output("$PSVersionTable.PSVersion.Major")
+	major := strings.TrimSpace(string(out))
+	if major != "" && !strings.Contains(major, "$PSVersionTable") {
+		if _, err := strconv.Atoi(major); err == nil {
+			return shellPowerShell, nil
+		}
+	}
+	return shellCmd, nil
 }
 
-func buildCmd(name string, args ...string) string {
+func buildCmd(shell remoteShell, name string, args ...string) string {
 	cmds := make([]string, 0, len(args)+1)
 	cmds = append(cmds, name)
 	for _, arg := range args {
-		cmds = append(cmds, strconv.Quote(arg))
+		cmds = append(cmds, quoteArg(shell, arg))
 	}
 	return strings.Join(cmds, " ")
 }
 
+// quoteArg quotes arg for inclusion in a command line run under shell.
+func quoteArg(shell remoteShell, arg string) string {
+	switch shell {
+	case shellPowerShell:
+		// PowerShell doesn't recognize Go-style backslash escapes, but a
+		// single-quoted literal (with embedded single quotes doubled)
+		// round-trips any value unchanged.
+		return "'" + strings.ReplaceAll(arg, "'", "''") + "'"
+	case shellCmd:
+		return quoteArgCmd(arg)
+	default:
+		return strconv.Quote(arg)
+	}
+}
+
+// quoteArgCmd quotes arg for cmd.exe: embedded double quotes are doubled
+// so the quoted segment stays intact, and a literal "%" is caret-escaped
+// since cmd.exe expands %VAR% even inside double quotes.
+func quoteArgCmd(arg string) string {
+	arg = strings.ReplaceAll(arg, `"`, `""`)
+	arg = strings.ReplaceAll(arg, "%", "^%")
+	return `"` + arg + `"`
+}
+
+// CommandDialContext runs name with args as a command on the remote host
+// and returns a net.Conn wired to its stdin/stdout, letting the session be
+// used as a transport for any stream protocol the command speaks.
 func (d *Dialer) CommandDialContext(ctx context.Context, name string, args ...string) (net.Conn, error) {
+	shell, err := d.detectShell(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return d.execDialContext(ctx, buildCmd(shell, name, args...))
+}
+
+// DialDockerStdio runs "docker system dial-stdio" on the remote host and
+// returns a net.Conn to it, the same mechanism the "ssh://" Docker CLI
+// context uses to reach a remote engine.
+func (d *Dialer) DialDockerStdio(ctx context.Context) (net.Conn, error) {
+	return d.CommandDialContext(ctx, "docker", "system", "dial-stdio")
+}
+
+// DialUnixSocket relays to a Unix domain socket at path on the remote
+// host via socat, so local callers can reach it as if it were a net.Conn.
+func (d *Dialer) DialUnixSocket(ctx context.Context, path string) (net.Conn, error) {
+	return d.CommandDialContext(ctx, "socat", "-", "UNIX-CONNECT:"+path)
+}
+
+// execDialContext starts cmd in a new SSH session and returns a net.Conn
+// wired to its stdin/stdout.
+func (d *Dialer) execDialContext(ctx context.Context, cmd string) (net.Conn, error) {
 	cli, err := d.SSHClient(ctx)
 	if err != nil {
 		return nil, err
@@ -181,7 +454,6 @@ func (d *Dialer) CommandDialContext(ctx context.Context, name string, args ...st
 	sess.Stdout = conn1
 	sess.Stderr = os.Stderr
 
-	cmd := buildCmd(name, args...)
 	err = sess.Start(cmd)
 	if err != nil {
 		return nil, err
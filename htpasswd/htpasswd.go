@@ -0,0 +1,103 @@
+// Package htpasswd lets a server authenticate against an Apache htpasswd
+// credential file, reloading it periodically so operators can add or
+// revoke users without restarting the proxy.
+package htpasswd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tg123/go-htpasswd"
+)
+
+// File is an htpasswd credential file that is re-read periodically and
+// swapped atomically under an RWMutex.
+type File struct {
+	path    string
+	period  time.Duration
+	onError func(error)
+
+	mut        sync.RWMutex
+	file       *htpasswd.File
+	latestTime time.Time
+}
+
+// New loads the htpasswd file at path and returns a File that re-reads it
+// on the first Match after period has elapsed since the last successful
+// load (the same time-based pattern as permissions.PermissionsFromFile.check;
+// the file's mtime is not consulted). onError, if non-nil, is called with
+// any error encountered while reloading; the previously loaded credentials
+// keep serving until a reload succeeds, and every Match retries the reload
+// until then.
+func New(path string, period time.Duration, onError func(error)) (*File, error) {
+	if period < time.Second {
+		period = time.Second
+	}
+	f := &File{
+		path:    path,
+		period:  period,
+		onError: onError,
+	}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) get() (*htpasswd.File, time.Time) {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	return f.file, f.latestTime
+}
+
+func (f *File) check() *htpasswd.File {
+	file, latest := f.get()
+	if file == nil || time.Since(latest) > f.period {
+		if err := f.reload(); err != nil {
+			if onError := f.getOnError(); onError != nil {
+				onError(err)
+			}
+		}
+		file, _ = f.get()
+	}
+	return file
+}
+
+// SetOnError replaces the callback invoked when a reload fails. It is
+// safe to call concurrently with Match, so a caller that only learns its
+// logger after New has already returned (e.g. to tie it to a server
+// that isn't fully constructed yet) can attach it afterwards.
+func (f *File) SetOnError(onError func(error)) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.onError = onError
+}
+
+func (f *File) getOnError() func(error) {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	return f.onError
+}
+
+func (f *File) reload() error {
+	file, err := htpasswd.New(f.path, htpasswd.DefaultSystems, nil)
+	if err != nil {
+		return err
+	}
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.file = file
+	f.latestTime = time.Now()
+	return nil
+}
+
+// Match reports whether username/password matches a credential in the
+// htpasswd file, reloading it first if period has elapsed since the
+// last reload.
+func (f *File) Match(username, password string) bool {
+	file := f.check()
+	if file == nil {
+		return false
+	}
+	return file.Match(username, password)
+}
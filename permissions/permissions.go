@@ -3,11 +3,32 @@ package permissions
 import (
 	"encoding/json"
 	"github.com/wzshiming/sshd"
+	"net"
 	"os"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Requests whose args is a "host:port" pair rather than an opaque string,
+// so Permission.Allow matches it with host globs and port ranges instead
+// of exact string equality.
+const (
+	DirectTCPIP  = "direct-tcpip"
+	TCPIPForward = "tcpip-forward"
+)
+
+// Requests whose args is a filesystem path (a Unix domain socket), so
+// Permission.Allow matches it with path globs (e.g. "/var/run/*.sock")
+// instead of exact string equality. Unlike a "host:port" pair, a socket
+// path has no colon-delimited port to split out.
+const (
+	DirectStreamLocal  = "direct-streamlocal@openssh.com"
+	StreamLocalForward = "streamlocal-forward@openssh.com"
+)
+
 type Permissions map[string]Permission
 
 func (p Permissions) Allow(req string, args string) bool {
@@ -25,9 +46,16 @@ type Permission struct {
 }
 
 func (p Permission) Allow(req string, args string) bool {
+	match := stringEqual
+	switch {
+	case isHostPortReq(req):
+		match = matchHostPort
+	case isPathReq(req):
+		match = matchPath
+	}
 	if p.Allows != nil {
 		for _, item := range p.Allows {
-			if item == args {
+			if match(item, args) {
 				return true
 			}
 		}
@@ -35,7 +63,7 @@ func (p Permission) Allow(req string, args string) bool {
 	}
 	if p.Blocks != nil {
 		for _, item := range p.Blocks {
-			if item == args {
+			if match(item, args) {
 				return false
 			}
 		}
@@ -44,6 +72,82 @@ func (p Permission) Allow(req string, args string) bool {
 	return p.Default
 }
 
+func isHostPortReq(req string) bool {
+	switch req {
+	case DirectTCPIP, TCPIPForward:
+		return true
+	}
+	return false
+}
+
+func isPathReq(req string) bool {
+	switch req {
+	case DirectStreamLocal, StreamLocalForward:
+		return true
+	}
+	return false
+}
+
+func stringEqual(pattern, s string) bool {
+	return pattern == s
+}
+
+// matchPath reports whether pattern, a filesystem path that may contain
+// glob wildcards (e.g. "/var/run/*.sock"), matches the Unix domain socket
+// path s.
+func matchPath(pattern, s string) bool {
+	ok, err := path.Match(pattern, s)
+	return err == nil && ok
+}
+
+// matchHostPort reports whether pattern, a "host:port" pair where host
+// may contain glob wildcards (e.g. "*.internal:22") and port may be a
+// single number, "*", or a range ("1024-65535"), matches hostport.
+func matchHostPort(pattern, hostport string) bool {
+	patHost, patPort, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return false
+	}
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+
+	ok, err := path.Match(patHost, host)
+	if err != nil || !ok {
+		return false
+	}
+
+	return matchPort(patPort, portStr)
+}
+
+func matchPort(pattern, portStr string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+
+	lo, hi, isRange := strings.Cut(pattern, "-")
+	if !isRange {
+		p, err := strconv.Atoi(pattern)
+		return err == nil && p == port
+	}
+
+	loN, err := strconv.Atoi(lo)
+	if err != nil {
+		return false
+	}
+	hiN, err := strconv.Atoi(hi)
+	if err != nil {
+		return false
+	}
+	return port >= loN && port <= hiN
+}
+
 type PermissionsFromFile struct {
 	permissions *Permissions
 	path        string
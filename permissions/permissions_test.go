@@ -0,0 +1,79 @@
+package permissions
+
+import "testing"
+
+func TestPermissionAllowHostPort(t *testing.T) {
+	perm := Permission{
+		Allows: []string{"*.internal:22", "10.0.0.1:8000-9000"},
+	}
+
+	cases := []struct {
+		args string
+		want bool
+	}{
+		{"db.internal:22", true},
+		{"db.internal:2222", false},
+		{"10.0.0.1:8080", true},
+		{"10.0.0.1:80", false},
+		{"10.0.0.2:8080", false},
+	}
+	for _, c := range cases {
+		if got := perm.Allow(DirectTCPIP, c.args); got != c.want {
+			t.Errorf("Allow(%q, %q) = %v, want %v", DirectTCPIP, c.args, got, c.want)
+		}
+	}
+}
+
+func TestPermissionAllowHostPortWildcardPort(t *testing.T) {
+	perm := Permission{Allows: []string{"db.internal:*"}}
+	if !perm.Allow(TCPIPForward, "db.internal:5432") {
+		t.Error("expected wildcard port to match")
+	}
+	if perm.Allow(TCPIPForward, "other.internal:5432") {
+		t.Error("expected non-matching host to be denied")
+	}
+}
+
+func TestPermissionAllowStreamLocalPath(t *testing.T) {
+	perm := Permission{
+		Allows: []string{"/var/run/docker.sock", "/var/run/user/*.sock"},
+	}
+
+	cases := []struct {
+		args string
+		want bool
+	}{
+		{"/var/run/docker.sock", true},
+		{"/var/run/user/1000.sock", true},
+		{"/var/run/other.sock", false},
+	}
+	for _, c := range cases {
+		if got := perm.Allow(DirectStreamLocal, c.args); got != c.want {
+			t.Errorf("Allow(%q, %q) = %v, want %v", DirectStreamLocal, c.args, got, c.want)
+		}
+	}
+}
+
+func TestPermissionBlockStreamLocalPath(t *testing.T) {
+	perm := Permission{
+		Default: true,
+		Blocks:  []string{"/var/run/docker.sock"},
+	}
+
+	if perm.Allow(StreamLocalForward, "/var/run/docker.sock") {
+		t.Error("expected blocked socket path to be denied")
+	}
+	if !perm.Allow(StreamLocalForward, "/var/run/other.sock") {
+		t.Error("expected non-blocked socket path to fall through to default")
+	}
+}
+
+func TestPermissionAllowOpaqueArgs(t *testing.T) {
+	perm := Permission{Allows: []string{"exact"}}
+	if !perm.Allow("session", "exact") {
+		t.Error("expected exact string match to be allowed")
+	}
+	if perm.Allow("session", "exac*") {
+		t.Error("opaque request args must not be glob-matched")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/wzshiming/sshd"
+	"github.com/wzshiming/sshproxy/htpasswd"
 	"github.com/wzshiming/sshproxy/permissions"
 	"golang.org/x/crypto/ssh"
 )
@@ -23,11 +24,16 @@ type SimpleServer struct {
 	Password string
 	Network  string
 	Address  string
+
+	// AuditLogger receives an AuditAuthAttempt event for every
+	// authentication attempt. It defaults to NoopAuditLogger; set it
+	// before Start/Run to record an audit trail.
+	AuditLogger AuditLogger
 }
 
 // NewSimpleServer creates a new NewSimpleServer
 func NewSimpleServer(addr string) (*SimpleServer, error) {
-	user, pwd, host, config, userPermissions, err := serverConfig(addr)
+	user, pwd, host, config, userPermissions, hf, err := serverConfig(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -37,18 +43,59 @@ func NewSimpleServer(addr string) (*SimpleServer, error) {
 			ServerConfig:    *config,
 			UserPermissions: userPermissions,
 		},
-		Network:  "tcp",
-		Address:  host,
-		Username: user,
-		Password: pwd,
+		Network:     "tcp",
+		Address:     host,
+		Username:    user,
+		Password:    pwd,
+		AuditLogger: NoopAuditLogger{},
+	}
+
+	if hf != nil {
+		hf.SetOnError(func(err error) {
+			if s.Logger != nil {
+				s.Logger.Println("htpasswd reload:", err)
+			}
+		})
 	}
+
+	if cb := s.Server.ServerConfig.PasswordCallback; cb != nil {
+		s.Server.ServerConfig.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			perm, err := cb(conn, password)
+			s.AuditLogger.LogAudit(authAttemptEvent(conn, err))
+			return perm, err
+		}
+	}
+	if cb := s.Server.ServerConfig.PublicKeyCallback; cb != nil {
+		s.Server.ServerConfig.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			perm, err := cb(conn, key)
+			s.AuditLogger.LogAudit(authAttemptEvent(conn, err))
+			return perm, err
+		}
+	}
+
 	return s, nil
 }
 
-func serverConfig(addr string) (host, user, pwd string, config *ssh.ServerConfig, userPermissions func(user string) sshd.Permissions, err error) {
+// authAttemptEvent builds the AuditAuthAttempt event for one authentication
+// callback invocation.
+func authAttemptEvent(conn ssh.ConnMetadata, err error) AuditEvent {
+	event := AuditEvent{
+		Type:       AuditAuthAttempt,
+		Time:       time.Now(),
+		User:       conn.User(),
+		RemoteAddr: conn.RemoteAddr().String(),
+		Allowed:    err == nil,
+	}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	return event
+}
+
+func serverConfig(addr string) (host, user, pwd string, config *ssh.ServerConfig, userPermissions func(user string) sshd.Permissions, hf *htpasswd.File, err error) {
 	ur, err := url.Parse(addr)
 	if err != nil {
-		return "", "", "", nil, nil, err
+		return "", "", "", nil, nil, nil, err
 	}
 
 	isPwd := false
@@ -73,21 +120,47 @@ func serverConfig(addr string) (host, user, pwd string, config *ssh.ServerConfig
 		pwd = ""
 	}
 
+	if htpasswdFile := ur.Query().Get("htpasswd_file"); htpasswdFile != "" {
+		htpasswdReload := 30 * time.Second
+		if reloadStr := ur.Query().Get("htpasswd_reload"); reloadStr != "" {
+			htpasswdReload, err = time.ParseDuration(reloadStr)
+			if err != nil {
+				return "", "", "", nil, nil, nil, err
+			}
+		}
+		staticCallback := config.PasswordCallback
+		hf, err = htpasswd.New(htpasswdFile, htpasswdReload, nil)
+		if err != nil {
+			return "", "", "", nil, nil, nil, err
+		}
+		config.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if staticCallback != nil {
+				if p, err := staticCallback(conn, password); err == nil {
+					return p, nil
+				}
+			}
+			if hf.Match(conn.User(), string(password)) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("denied")
+		}
+	}
+
 	hostkeyDatas, err := getQuery(ur.Query()["hostkey_data"], ur.Query()["hostkey_file"])
 	if err != nil {
-		return "", "", "", nil, nil, err
+		return "", "", "", nil, nil, nil, err
 	}
 	if len(hostkeyDatas) == 0 {
 		key, err := sshd.RandomHostkey()
 		if err != nil {
-			return "", "", "", nil, nil, err
+			return "", "", "", nil, nil, nil, err
 		}
 		config.AddHostKey(key)
 	} else {
 		for _, data := range hostkeyDatas {
 			key, err := sshd.ParseHostkey(data)
 			if err != nil {
-				return "", "", "", nil, nil, err
+				return "", "", "", nil, nil, nil, err
 			}
 			config.AddHostKey(key)
 		}
@@ -96,12 +169,12 @@ func serverConfig(addr string) (host, user, pwd string, config *ssh.ServerConfig
 	pks := []func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error){}
 	authorizedDatas, err := getQuery(ur.Query()["authorized_data"], ur.Query()["authorized_file"])
 	if err != nil {
-		return "", "", "", nil, nil, err
+		return "", "", "", nil, nil, nil, err
 	}
 	if len(authorizedDatas) != 0 {
 		keys, err := sshd.ParseAuthorized(bytes.NewBuffer(bytes.Join(authorizedDatas, []byte{'\n'})))
 		if err != nil {
-			return "", "", "", nil, nil, err
+			return "", "", "", nil, nil, nil, err
 		}
 		if len(keys.Data) != 0 {
 			pks = append(pks, func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
@@ -114,6 +187,50 @@ func serverConfig(addr string) (host, user, pwd string, config *ssh.ServerConfig
 		}
 	}
 
+	trustedCADatas, err := getQuery(ur.Query()["trusted_user_ca_data"], ur.Query()["trusted_user_ca_file"])
+	if err != nil {
+		return "", "", "", nil, nil, nil, err
+	}
+	if len(trustedCADatas) != 0 {
+		var cas []ssh.PublicKey
+		for _, data := range bytes.Split(bytes.Join(trustedCADatas, []byte{'\n'}), []byte{'\n'}) {
+			data = bytes.TrimSpace(data)
+			if len(data) == 0 {
+				continue
+			}
+			ca, _, _, _, err := ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return "", "", "", nil, nil, nil, err
+			}
+			cas = append(cas, ca)
+		}
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool {
+				for _, ca := range cas {
+					if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+						return true
+					}
+				}
+				return false
+			},
+			// force-command is the one critical option sshproxy
+			// understands; listing it here is required for
+			// CheckCert to accept a certificate that carries it,
+			// otherwise authentication fails outright with
+			// "unsupported critical option". sshproxy itself does
+			// not yet run the forced command - a caller wanting it
+			// enforced must read Permissions.CriticalOptions
+			// itself, the same place CertChecker.Authenticate
+			// leaves it.
+			SupportedCriticalOptions: []string{"force-command"},
+		}
+		// CertChecker.Authenticate validates CertType, ValidBefore/
+		// ValidAfter and ValidPrincipals against conn.User(), and
+		// already carries the certificate's CriticalOptions and
+		// Extensions into the returned *ssh.Permissions.
+		pks = append(pks, checker.Authenticate)
+	}
+
 	homeDirs := ur.Query()["home_dir"]
 	if len(homeDirs) != 0 && homeDirs[0] != "" {
 		homeDir := homeDirs[0]
@@ -188,7 +305,8 @@ func serverConfig(addr string) (host, user, pwd string, config *ssh.ServerConfig
 		port = "22"
 	}
 	host = net.JoinHostPort(host, port)
-	return user, pwd, host, config, userPermissions, nil
+
+	return user, pwd, host, config, userPermissions, hf, nil
 }
 
 // Run the server
@@ -233,5 +351,9 @@ func (s *SimpleServer) ProxyURL() string {
 	if s.Username != "" {
 		u.User = url.UserPassword(s.Username, s.Password)
 	}
+	// Unless hostkey_data or hostkey_file is given, the server's host key is
+	// freshly generated each run (see serverConfig). The URL always carries
+	// insecure=1, so a Dialer built from it does not verify the host key.
+	u.RawQuery = "insecure=1"
 	return u.String()
 }